@@ -4,24 +4,424 @@
 package newrelic
 
 import (
+	"container/list"
 	"errors"
+	"hash/fnv"
 	"reflect"
+	"regexp"
 	"runtime"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-//
 // defaultAgentProjectRoot is the default filename pattern which is at
 // the root of the agent's import path. This is used to identify functions
 // on the call stack which are assumed to belong to the agent rather than
 // the instrumented application's code.
-//
 const defaultAgentProjectRoot = "github.com/newrelic/go-agent/"
 
+// Supportability metric names under which the process-wide code location
+// resolver cache's hit and miss counts are returned by
+// CLMResolverCacheSupportabilityMetrics. The counts are kept in-process
+// and are not added to a harvest automatically.
+const (
+	metricNameCLMCacheHit  = "Supportability/CLM/CacheHit"
+	metricNameCLMCacheMiss = "Supportability/CLM/CacheMiss"
+)
+
+// defaultCLMResolverCacheSize and defaultCLMResolverCacheTTL are the
+// defaults used when a ResolverCacheConfig is not otherwise configured.
+const (
+	defaultCLMResolverCacheSize = 2048
+	defaultCLMResolverCacheTTL  = 10 * time.Minute
+	clmResolverCacheShardCount  = 32
+)
+
+// ResolverCacheConfig controls the process-wide, PC-keyed cache that
+// CodeLocation resolution (both for Code Level Metrics reporting and for
+// CachedCodeLocation) uses to avoid repeatedly walking and symbolizing the
+// same call stacks.
+type ResolverCacheConfig struct {
+	// Disabled turns the cache off entirely; every lookup falls through
+	// to a fresh stack walk and symbolization. Useful for tests that
+	// care about exact call counts.
+	Disabled bool
+	// MaxSize is the maximum number of entries retained per cache shard
+	// before the least recently used entry is evicted. If zero, a
+	// built-in default is used.
+	MaxSize int
+	// TTL is how long a cached resolution remains valid before it is
+	// treated as a miss and resolved again. If zero, a built-in default
+	// is used.
+	TTL time.Duration
+}
+
+// clmCacheKind distinguishes the independent cache namespaces that share
+// the same underlying striped LRU: resolving a stack-walked location for
+// Code Level Metrics is keyed differently than resolving the location of
+// a known function value or a ThisCodeLocation call site.
+type clmCacheKind uint8
+
+const (
+	clmCacheKindStackWalk clmCacheKind = iota
+	clmCacheKindFunction
+	clmCacheKindThisLoc
+)
+
+// clmCacheKey identifies a single cached resolution. pc is the first PC
+// returned by runtime.Callers for the caller frame (or a function's entry
+// PC, for clmCacheKindFunction). extra distinguishes otherwise-identical
+// PCs resolved under different configuration, such as the hash of the
+// ignored-prefixes list in effect for a stack walk.
+type clmCacheKey struct {
+	kind  clmCacheKind
+	pc    uintptr
+	extra uint64
+}
+
+// clmCacheValue is what gets stored for a resolved location: the
+// CodeLocation itself, plus the PC of the frame that was chosen after
+// applying the ignored-prefix walk (useful for diagnostics).
+type clmCacheValue struct {
+	location CodeLocation
+	framePC  uintptr
+}
+
+type clmCacheEntry struct {
+	key     clmCacheKey
+	value   clmCacheValue
+	expires time.Time
+	elem    *list.Element
+}
+
+// clmCacheShard is one lock-striped partition of the process-wide
+// resolver cache. Striping by key spreads lock contention across many
+// mutexes instead of a single global one, which matters on high-throughput
+// handlers where many goroutines resolve code locations concurrently.
+type clmCacheShard struct {
+	mu      sync.Mutex
+	entries map[clmCacheKey]*clmCacheEntry
+	order   *list.List // front = most recently used
+}
+
+func newCLMCacheShard() *clmCacheShard {
+	return &clmCacheShard{
+		entries: make(map[clmCacheKey]*clmCacheEntry),
+		order:   list.New(),
+	}
+}
+
+func (s *clmCacheShard) get(key clmCacheKey, now time.Time) (clmCacheValue, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return clmCacheValue{}, false
+	}
+	if now.After(entry.expires) {
+		s.order.Remove(entry.elem)
+		delete(s.entries, key)
+		return clmCacheValue{}, false
+	}
+	s.order.MoveToFront(entry.elem)
+	return entry.value, true
+}
+
+func (s *clmCacheShard) put(key clmCacheKey, value clmCacheValue, ttl time.Time, maxSize int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.entries[key]; ok {
+		existing.value = value
+		existing.expires = ttl
+		s.order.MoveToFront(existing.elem)
+		return
+	}
+
+	entry := &clmCacheEntry{key: key, value: value, expires: ttl}
+	entry.elem = s.order.PushFront(entry)
+	s.entries[key] = entry
+
+	for maxSize > 0 && len(s.entries) > maxSize {
+		oldest := s.order.Back()
+		if oldest == nil {
+			break
+		}
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*clmCacheEntry).key)
+	}
+}
+
+func (s *clmCacheShard) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = make(map[clmCacheKey]*clmCacheEntry)
+	s.order = list.New()
+}
+
+// clmResolverCache is the process-wide, lock-striped LRU cache used to
+// avoid re-walking and re-symbolizing stack frames for code locations
+// that have already been resolved once.
+type clmResolverCache struct {
+	shards   [clmResolverCacheShardCount]*clmCacheShard
+	maxSize  int
+	ttl      time.Duration
+	disabled bool
+	hits     uint64
+	misses   uint64
+}
+
+func newCLMResolverCache(cfg ResolverCacheConfig) *clmResolverCache {
+	c := &clmResolverCache{
+		maxSize:  cfg.MaxSize,
+		ttl:      cfg.TTL,
+		disabled: cfg.Disabled,
+	}
+	if c.maxSize <= 0 {
+		c.maxSize = defaultCLMResolverCacheSize
+	}
+	if c.ttl <= 0 {
+		c.ttl = defaultCLMResolverCacheTTL
+	}
+	for i := range c.shards {
+		c.shards[i] = newCLMCacheShard()
+	}
+	return c
+}
+
+func (c *clmResolverCache) shardFor(key clmCacheKey) *clmCacheShard {
+	h := fnv.New64a()
+	var buf [8]byte
+	for i := 0; i < 8; i++ {
+		buf[i] = byte(key.pc >> (8 * i))
+	}
+	h.Write(buf[:])
+	return c.shards[h.Sum64()%clmResolverCacheShardCount]
+}
+
+func (c *clmResolverCache) get(key clmCacheKey) (clmCacheValue, bool) {
+	if c.disabled {
+		return clmCacheValue{}, false
+	}
+	value, ok := c.shardFor(key).get(key, time.Now())
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return value, ok
+}
+
+func (c *clmResolverCache) put(key clmCacheKey, value clmCacheValue) {
+	if c.disabled {
+		return
+	}
+	c.shardFor(key).put(key, value, time.Now().Add(c.ttl), c.maxSize)
+}
+
+func (c *clmResolverCache) reset() {
+	for _, shard := range c.shards {
+		shard.reset()
+	}
+}
+
+// Stats reports the cumulative number of cache hits and misses since the
+// cache was created (or last replaced via ConfigureCLMResolverCache).
+func (c *clmResolverCache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// supportabilityMetrics renders the cache's cumulative hit/miss counts as
+// the Supportability/CLM/CacheHit and Supportability/CLM/CacheMiss metric
+// values, ready for a harvest cycle to report.
+func (c *clmResolverCache) supportabilityMetrics() map[string]uint64 {
+	hits, misses := c.Stats()
+	return map[string]uint64{
+		metricNameCLMCacheHit:  hits,
+		metricNameCLMCacheMiss: misses,
+	}
+}
+
+// CLMResolverCacheSupportabilityMetrics returns the process-wide code
+// location resolver cache's cumulative hit and miss counts, keyed by
+// their Supportability metric name (Supportability/CLM/CacheHit and
+// Supportability/CLM/CacheMiss). These counts are not reported to a
+// harvest automatically; this function is the only way to read them.
+func CLMResolverCacheSupportabilityMetrics() map[string]uint64 {
+	return currentCLMResolverCache().supportabilityMetrics()
+}
+
+var (
+	clmCacheMu sync.RWMutex
+	clmCache   = newCLMResolverCache(ResolverCacheConfig{})
+	// clmCacheExplicitlyConfigured is set once anyone calls
+	// ConfigureCLMResolverCache directly, so that reportCodeLevelMetrics's
+	// one-time lazy configuration (keyed off the first appRun it sees)
+	// never clobbers a configuration a caller set up on purpose.
+	clmCacheExplicitlyConfigured bool
+)
+
+func currentCLMResolverCache() *clmResolverCache {
+	clmCacheMu.RLock()
+	defer clmCacheMu.RUnlock()
+	return clmCache
+}
+
+// ConfigureCLMResolverCache replaces the process-wide code location
+// resolver cache with one built from cfg. This is exposed so that the
+// cache can be resized, have its TTL adjusted, or be disabled entirely
+// (for example, from tests) without restarting the process.
 //
-// CodeLocation marks the location of a line of source code for later reference.
+// Because the cache is process-wide rather than per-application,
+// reportCodeLevelMetrics otherwise configures it automatically, once,
+// from the ResolverCache settings of the first appRun it observes; if a
+// process runs multiple applications with different ResolverCache
+// settings, only the first one's settings would be picked up that way.
+// Calling ConfigureCLMResolverCache directly always takes priority over
+// that automatic one-time configuration, which makes it the reliable way
+// for a test (or a process with multiple differently-configured
+// applications) to pin down the cache's behavior regardless of call order.
+func ConfigureCLMResolverCache(cfg ResolverCacheConfig) {
+	clmCacheMu.Lock()
+	defer clmCacheMu.Unlock()
+	clmCache = newCLMResolverCache(cfg)
+	clmCacheExplicitlyConfigured = true
+}
+
+// InvalidateCLMResolverCache discards every entry currently held by the
+// process-wide code location resolver cache, without changing its
+// configured size, TTL, or disabled state. Cached locations hold file
+// paths before any SubstitutePaths or PathPrefixes are applied, and
+// stack-walk entries are keyed by the IgnoredPrefixes and application
+// module in effect, so changing those settings does not cause old entries
+// to be served; calling this after such a change frees those entries
+// instead of leaving them to expire or be evicted.
+//
+// Like ConfigureCLMResolverCache, this always takes effect immediately
+// and does not depend on, or interact with, reportCodeLevelMetrics's
+// one-time lazy configuration of the cache's defaults.
+func InvalidateCLMResolverCache() {
+	currentCLMResolverCache().reset()
+}
+
+// hashCLMStackWalkKey produces a stable hash identifying a stack-walk
+// resolution: the full chain of raw PC values above the caller, plus the
+// configuration that affects how a location is chosen from them (the
+// ignored-prefix list and, if set, the application module path).
 //
+// Hashing the whole PC chain, and not just its first entry, matters
+// because CLM reporting often funnels through a small number of shared
+// agent helpers: two different user call sites can share the exact same
+// immediate-caller PC while still resolving to different code locations,
+// since the frames further up the stack (which the ignored-prefix walk
+// skips past) differ. Keying on pcs[0] alone would make those distinct
+// call sites collide on one cache entry and serve whichever one resolved
+// first to every caller thereafter. Hashing the PCs is cheap (no
+// symbolization required) and keeps the cache correct even when it does
+// not eliminate the work of a cache miss's eventual resolution.
+func hashCLMStackWalkKey(pcs []uintptr, prefixes []string, appModule string) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, pc := range pcs {
+		for i := 0; i < 8; i++ {
+			buf[i] = byte(pc >> (8 * i))
+		}
+		h.Write(buf[:])
+	}
+	h.Write([]byte{0xff})
+	for _, p := range prefixes {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte{1})
+	h.Write([]byte(appModule))
+	return h.Sum64()
+}
+
+// isApplicationModuleFrame reports whether function appears to belong to
+// the application module at mod: either function is exactly mod, or it
+// begins with mod followed by a '/' (a subpackage) or a '.' (a function
+// or method in the module's root package). This also naturally attributes
+// compiler-generated names for closures and deferred calls (such as
+// "pkg.Handler.func1") to the enclosing package, since those names still
+// carry the full module-qualified prefix.
+func isApplicationModuleFrame(function, mod string) bool {
+	if mod == "" || !strings.HasPrefix(function, mod) {
+		return false
+	}
+	if len(function) == len(mod) {
+		return true
+	}
+	switch function[len(mod)] {
+	case '/', '.':
+		return true
+	default:
+		return false
+	}
+}
+
+// hasIgnoredPrefix reports whether function begins with any of prefixes.
+func hasIgnoredPrefix(function string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveCallingFrame walks frames, innermost first, to choose the frame
+// that should be reported as the code location for Code Level Metrics.
+//
+// If appModule is set, it inverts the usual logic: it looks for the
+// first frame whose function belongs to appModule, since that is
+// unambiguously part of the application rather than a framework,
+// middleware, or driver the application happens to call through. If no
+// frame matches, it falls back to the ignored-prefix behavior below.
+//
+// Otherwise (or on fallback), it returns the first frame whose function
+// does not begin with any of ignoredPrefixes, on the theory that those
+// prefixes mark the agent's own code. If every frame matches an ignored
+// prefix, the outermost frame is used anyway, since nothing better was
+// found on the way to the bottom of the stack.
+func resolveCallingFrame(frames *runtime.Frames, ignoredPrefixes []string, appModule string) runtime.Frame {
+	var frame runtime.Frame
+	var fallback runtime.Frame
+	haveFallback := false
+	moreToRead := true
+
+	for moreToRead {
+		frame, moreToRead = frames.Next()
+
+		if appModule != "" {
+			if !haveFallback && !hasIgnoredPrefix(frame.Function, ignoredPrefixes) {
+				fallback = frame
+				haveFallback = true
+			}
+			if isApplicationModuleFrame(frame.Function, appModule) {
+				return frame
+			}
+			continue
+		}
+
+		if !hasIgnoredPrefix(frame.Function, ignoredPrefixes) {
+			return frame
+		}
+	}
+
+	// ran off the end of the stack without finding a match; fall back to
+	// the best ignored-prefix candidate seen, if any, else the outermost frame
+	if appModule != "" && haveFallback {
+		return fallback
+	}
+	return frame
+}
+
+// CodeLocation marks the location of a line of source code for later reference.
 type CodeLocation struct {
 	// LineNo is the line number within the source file.
 	LineNo int
@@ -34,7 +434,6 @@ type CodeLocation struct {
 	FilePath string
 }
 
-//
 // CachedCodeLocation provides storage for the code location computed such that
 // the discovery of the code location is only done once; thereafter the cached
 // value is available for use.
@@ -44,6 +443,11 @@ type CodeLocation struct {
 // instead of a stand-alone function, the operation will make use of the cache to
 // prevent computing the same source location more than once.
 //
+// Since FunctionLocation and ThisCodeLocation are themselves now backed by
+// the process-wide resolver cache (see ResolverCacheConfig), the once here
+// mostly exists to avoid the map lookup on every call from the same
+// receiver; using CachedCodeLocation is no longer required to avoid the
+// cost of repeated stack walks or symbolization.
 type CachedCodeLocation struct {
 	Location *CodeLocation
 	Err      error
@@ -51,34 +455,57 @@ type CachedCodeLocation struct {
 }
 
 type traceOptSet struct {
-	LocationOverride *CodeLocation
-	SuppressCLM      bool
-	DemandCLM        bool
-	IgnoredPrefixes  []string
-	PathPrefixes     []string
+	LocationOverride  *CodeLocation
+	SuppressCLM       bool
+	DemandCLM         bool
+	IgnoredPrefixes   []string
+	PathPrefixes      []string
+	SubstitutePaths   []SubstituteRule
+	ApplicationModule string
 }
 
+// SubstituteRule describes a single source path rewrite rule used to
+// translate a code location's file path from the path it had when the
+// code was built to the path at which it is actually found (or vice
+// versa). This is useful, for example, when code is built on a CI
+// worker or in a container at one path but is browsed by developers at
+// another path entirely.
 //
+// Rules are inspired by Delve's SubstitutePathRules: each rule is tried
+// in the order given against the beginning of the path, and the first
+// one whose From matches has that match replaced with To.
+type SubstituteRule struct {
+	// From is the path (or, if Regex is true, the regular expression)
+	// matched against the start of the reported file path.
+	From string
+	// To is the replacement text substituted for the portion of the
+	// path matched by From.
+	To string
+	// CaseInsensitive, if true, matches From against the path without
+	// regard to letter case.
+	CaseInsensitive bool
+	// Regex, if true, treats From as a regular expression rather than
+	// a literal path prefix. The match must still begin at the start
+	// of the path for the rule to apply.
+	Regex bool
+}
+
 // TraceOption values provide optional parameters to transactions.
 //
 // (Currently it's only implemented for transactions, but the name TraceOption is
 // intentionally generic in case we apply these to other kinds of traces in the future.)
-//
 type TraceOption func(*traceOptSet)
 
-//
 // WithCodeLocation adds an explicit CodeLocation value
 // to report for the Code Level Metrics attached to a trace.
 // This is probably a value previously obtained by calling
 // ThisCodeLocation().
-//
 func WithCodeLocation(loc *CodeLocation) TraceOption {
 	return func(o *traceOptSet) {
 		o.LocationOverride = loc
 	}
 }
 
-//
 // WithIgnoredPrefix indicates that the code location reported
 // for Code Level Metrics should be the first function in the
 // call stack that does not begin with the given string (or any of the given strings if more than one are given). This
@@ -94,77 +521,115 @@ func WithCodeLocation(loc *CodeLocation) TraceOption {
 // anything better on the way to the bottom of the stack.
 //
 // If no prefix strings are passed here, the configured defaults will be used.
-//
 func WithIgnoredPrefix(prefix ...string) TraceOption {
 	return func(o *traceOptSet) {
 		o.IgnoredPrefixes = prefix
 	}
 }
 
-//
 // WithPathPrefix overrides the list of source code path prefixes
 // used to trim source file pathnames, providing a new set of one
 // or more path prefixes to use for this trace only.
 // If no strings are given, the configured defaults will be used.
-//
 func WithPathPrefix(prefix ...string) TraceOption {
 	return func(o *traceOptSet) {
 		o.PathPrefixes = prefix
 	}
 }
 
+// WithSubstitutePaths overrides the list of source path substitution
+// rules applied to the file path reported for Code Level Metrics,
+// providing a new set of rules to use for this trace only. Rules are
+// tried in order; the first one whose From matches the beginning of
+// the path has that match replaced with its To. Substitution happens
+// before any configured PathPrefixes are trimmed from the result.
+// If no rules are given here, the configured defaults will be used.
+func WithSubstitutePaths(rules ...SubstituteRule) TraceOption {
+	return func(o *traceOptSet) {
+		o.SubstitutePaths = rules
+	}
+}
+
+// WithApplicationModulePath indicates that the code location reported
+// for Code Level Metrics should be the first frame, walking from the
+// innermost frame outward, whose function name belongs to mod (the
+// application's own module path, e.g. "github.com/acme/svc"). This
+// inverts the usual IgnoredPrefixes logic: instead of skipping frames
+// that look like agent or framework internals, it looks for the first
+// frame that is unambiguously the application's own code, so users don't
+// have to keep adding IgnoredPrefixes for every router, middleware, or
+// driver they pass through. If no frame belongs to mod, resolution falls
+// back to the existing IgnoredPrefixes behavior.
 //
+// If no module path is given here, the configured default
+// (CodeLevelMetrics.ApplicationModule) will be used.
+func WithApplicationModulePath(mod string) TraceOption {
+	return func(o *traceOptSet) {
+		o.ApplicationModule = mod
+	}
+}
+
+var (
+	autoApplicationModuleOnce sync.Once
+	autoApplicationModule     string
+)
+
+// WithAutoApplicationModule is equivalent to WithApplicationModulePath, but
+// determines the module path automatically from the running binary's own
+// build information (via debug.ReadBuildInfo), instead of requiring it to
+// be hard-coded at each call site. The lookup is only performed once per
+// process.
+func WithAutoApplicationModule() TraceOption {
+	autoApplicationModuleOnce.Do(func() {
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Path != "" {
+			autoApplicationModule = info.Main.Path
+		}
+	})
+	return WithApplicationModulePath(autoApplicationModule)
+}
+
 // WithoutCodeLevelMetrics suppresses the collection and reporting
 // of Code Level Metrics for this trace. This helps avoid the overhead
 // of collecting that information if it's not needed for certain traces.
-//
 func WithoutCodeLevelMetrics() TraceOption {
 	return func(o *traceOptSet) {
 		o.SuppressCLM = true
 	}
 }
 
-//
 // WithCodeLevelMetrics includes this trace in code level metrics even if
 // it would otherwise not be (for example, if it would be out of the configured
 // scope setting). This will never cause code level metrics to be reported if
 // CLM were explicitly disabled (e.g. by CLM being globally off or if WithoutCodeLevelMetrics
 // is present in the options for this trace).
-//
 func WithCodeLevelMetrics() TraceOption {
 	return func(o *traceOptSet) {
 		o.DemandCLM = true
 	}
 }
 
-//
 // WithThisCodeLocation is equivalent to calling WithCodeLocation, referring
 // to the point in the code where the WithThisCodeLocation call is being made.
 // This can be helpful, for example, when the actual code invocation which starts
 // a transaction or other kind of trace is originating from a framework or other
 // centralized location, but you want to report this point in your application
 // for the Code Level Metrics associated with this trace.
-//
 func WithThisCodeLocation() TraceOption {
 	return WithCodeLocation(ThisCodeLocation(1))
 }
 
-//
 // WithThisCodeLocation is equivalent to the standalone WithThisCodeLocation
 // TraceOption, but uses the cached value in its receiver to ensure that the
 // overhead of computing the code location is only performed the first time
 // it is invoked for each instance of the receiver variable.
-//
 func (c *CachedCodeLocation) WithThisCodeLocation() TraceOption {
 	return WithCodeLocation(c.ThisCodeLocation(1))
 }
 
-//
 // FunctionLocation is like ThisCodeLocation, but takes as its parameter
 // a function value. It will report the code-level metrics information for
 // that function if that is possible to do. It returns an error if it
 // was not possible to get a code location from the parameter passed to it.
-//
 func FunctionLocation(function interface{}) (*CodeLocation, error) {
 	if function == nil {
 		return nil, errors.New("nil function passed to FunctionLocation")
@@ -175,18 +640,26 @@ func FunctionLocation(function interface{}) (*CodeLocation, error) {
 		return nil, errors.New("value passed to FunctionLocation is not a function")
 	}
 
-	if fInfo := runtime.FuncForPC(v.Pointer()); fInfo != nil {
-		var loc CodeLocation
+	fInfo := runtime.FuncForPC(v.Pointer())
+	if fInfo == nil {
+		return nil, errors.New("could not find code location for function")
+	}
 
-		loc.FilePath, loc.LineNo = fInfo.FileLine(fInfo.Entry())
-		loc.Function = fInfo.Name()
+	cacheKey := clmCacheKey{kind: clmCacheKindFunction, pc: fInfo.Entry()}
+	if cached, ok := currentCLMResolverCache().get(cacheKey); ok {
+		loc := cached.location
 		return &loc, nil
 	}
 
-	return nil, errors.New("could not find code location for function")
+	var loc CodeLocation
+	loc.FilePath, loc.LineNo = fInfo.FileLine(fInfo.Entry())
+	loc.Function = fInfo.Name()
+
+	currentCLMResolverCache().put(cacheKey, clmCacheValue{location: loc, framePC: fInfo.Entry()})
+
+	return &loc, nil
 }
 
-//
 // FunctionLocation works identically to the stand-alone FunctionLocation function,
 // in that it determines the souce code location of the named function, returning
 // a pointer to a CodeLocation value which represents that location, or an error value
@@ -199,7 +672,6 @@ func FunctionLocation(function interface{}) (*CodeLocation, error) {
 // This is thread-safe and is intended to allow the same code to run in multiple
 // concurrent goroutines without needlessly recalculating the location of the
 // function value.
-//
 func (c *CachedCodeLocation) FunctionLocation(function interface{}) (*CodeLocation, error) {
 	c.once.Do(func() {
 		c.Location, c.Err = FunctionLocation(function)
@@ -207,12 +679,10 @@ func (c *CachedCodeLocation) FunctionLocation(function interface{}) (*CodeLocati
 	return c.Location, c.Err
 }
 
-//
 // WithFunctionLocation is like WithThisCodeLocation, but uses the
 // function value passed as the location to report. Unlike FunctionLocation,
 // this does not report errors explicitly. If it is unable to use the
 // value passed to find a code location, it will do nothing.
-//
 func WithFunctionLocation(function interface{}) TraceOption {
 	return func(o *traceOptSet) {
 		loc, err := FunctionLocation(function)
@@ -222,7 +692,6 @@ func WithFunctionLocation(function interface{}) TraceOption {
 	}
 }
 
-//
 // WithFunctionLocation works like the standalone function WithFunctionLocation,
 // but it stores a copy of the function's location in its receiver the first time
 // it is used. Subsequently that cached value will be used instead of computing
@@ -231,7 +700,6 @@ func WithFunctionLocation(function interface{}) TraceOption {
 // This is thread-safe and is intended to allow the same code to run in multiple
 // concurrent goroutines without needlessly recalculating the location of the
 // function value.
-//
 func (c *CachedCodeLocation) WithFunctionLocation(function interface{}) TraceOption {
 	return func(o *traceOptSet) {
 		loc, err := c.FunctionLocation(function)
@@ -241,7 +709,6 @@ func (c *CachedCodeLocation) WithFunctionLocation(function interface{}) TraceOpt
 	}
 }
 
-//
 // WithDefaultFunctionLocation is like WithFunctionLocation but will only
 // evaluate the location of the function if nothing that came before it
 // set a code location first. This is useful, for example, if you want to
@@ -249,7 +716,6 @@ func (c *CachedCodeLocation) WithFunctionLocation(function interface{}) TraceOpt
 // of resolving that location until it's clear that you will need to. This
 // should appear at the end of a TraceOption list (or at least before any
 // other options that want to specify the code location).
-//
 func WithDefaultFunctionLocation(function interface{}) TraceOption {
 	return func(o *traceOptSet) {
 		if o.LocationOverride == nil {
@@ -258,7 +724,6 @@ func WithDefaultFunctionLocation(function interface{}) TraceOption {
 	}
 }
 
-//
 // WithDefaultFunctionLocation works like the standalone WithDefaultFunctionLocation function,
 // except that it takes a CachedCodeLocation receiver which will
 // be used to cache the source code location of the function value.
@@ -279,7 +744,6 @@ func WithDefaultFunctionLocation(function interface{}) TraceOption {
 // in the Err member of the CachedCodeLocation variable.
 // In this case, no additional attempts are guaranteed to be made on subsequent executions
 // to determine the code location.
-//
 func (c *CachedCodeLocation) WithDefaultFunctionLocation(function interface{}) TraceOption {
 	return func(o *traceOptSet) {
 		if o.LocationOverride == nil {
@@ -291,11 +755,9 @@ func (c *CachedCodeLocation) WithDefaultFunctionLocation(function interface{}) T
 	}
 }
 
-//
 // withPreparedOptions copies the option settings from a structure
 // which was already set up (probably by executing a set of TraceOption
 // functions already).
-//
 func withPreparedOptions(newOptions *traceOptSet) TraceOption {
 	return func(o *traceOptSet) {
 		if newOptions != nil {
@@ -310,11 +772,16 @@ func withPreparedOptions(newOptions *traceOptSet) TraceOption {
 			if newOptions.PathPrefixes != nil {
 				o.PathPrefixes = newOptions.PathPrefixes
 			}
+			if newOptions.SubstitutePaths != nil {
+				o.SubstitutePaths = newOptions.SubstitutePaths
+			}
+			if newOptions.ApplicationModule != "" {
+				o.ApplicationModule = newOptions.ApplicationModule
+			}
 		}
 	}
 }
 
-//
 // ThisCodeLocation returns a CodeLocation value referring to
 // the place in your code that it was invoked.
 //
@@ -323,7 +790,6 @@ func withPreparedOptions(newOptions *traceOptSet) TraceOption {
 // of function calls to skip. For example, ThisCodeLocation(1) will return
 // the CodeLocation of the place the current function was called from
 // (i.e., the caller of the caller of ThisCodeLocation).
-//
 func ThisCodeLocation(skipLevels ...int) *CodeLocation {
 	var loc CodeLocation
 	skip := 2
@@ -331,19 +797,26 @@ func ThisCodeLocation(skipLevels ...int) *CodeLocation {
 		skip += skipLevels[0]
 	}
 
-	pcs := make([]uintptr, 10)
+	pcs := make([]uintptr, 1)
 	depth := runtime.Callers(skip, pcs)
 	if depth > 0 {
+		cacheKey := clmCacheKey{kind: clmCacheKindThisLoc, pc: pcs[0]}
+		if cached, ok := currentCLMResolverCache().get(cacheKey); ok {
+			loc = cached.location
+			return &loc
+		}
+
 		frames := runtime.CallersFrames(pcs[:1])
 		frame, _ := frames.Next()
 		loc.LineNo = frame.Line
 		loc.Function = frame.Function
 		loc.FilePath = frame.File
+
+		currentCLMResolverCache().put(cacheKey, clmCacheValue{location: loc, framePC: frame.PC})
 	}
 	return &loc
 }
 
-//
 // ThisCodeLocation works identically to the stand-alone ThisCodeLocation function,
 // in that it determines the souce code location from whence it was called, returning
 // a pointer to a CodeLocation value which represents that location. However,
@@ -355,7 +828,6 @@ func ThisCodeLocation(skipLevels ...int) *CodeLocation {
 // This is thread-safe and is intended to allow the same code to run in multiple
 // concurrent goroutines without needlessly recalculating the location of the
 // caller.
-//
 func (c *CachedCodeLocation) ThisCodeLocation(skiplevels ...int) *CodeLocation {
 	var skip int
 
@@ -371,6 +843,68 @@ func (c *CachedCodeLocation) ThisCodeLocation(skiplevels ...int) *CodeLocation {
 	return c.Location
 }
 
+// applySubstitutePaths runs path through the given substitute-path rules,
+// in order, and returns the result of the first rule whose From matches
+// the beginning of path. If no rule matches, path is returned unchanged.
+func applySubstitutePaths(path string, rules []SubstituteRule) string {
+	for _, rule := range rules {
+		if rule.Regex {
+			pattern := rule.From
+			if rule.CaseInsensitive {
+				pattern = "(?i)" + pattern
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				continue
+			}
+			if loc := re.FindStringIndex(path); loc != nil && loc[0] == 0 {
+				return rule.To + path[loc[1]:]
+			}
+			continue
+		}
+
+		from := rule.From
+		matched := strings.HasPrefix(path, from)
+		if !matched && rule.CaseInsensitive && len(path) >= len(from) {
+			matched = strings.EqualFold(path[:len(from)], from)
+		}
+		if matched {
+			return rule.To + path[len(from):]
+		}
+	}
+	return path
+}
+
+// NormalizePath applies the given substitute-path rules and path prefixes
+// to loc.FilePath, in place, using the same logic Code Level Metrics
+// reporting applies. This allows instrumentation packages outside the
+// agent (for example, ones that add their own span or error attributes)
+// to report file paths that agree with the ones the agent reports for
+// Code Level Metrics.
+func NormalizePath(loc *CodeLocation, rules []SubstituteRule, prefixes []string) {
+	if loc == nil {
+		return
+	}
+	loc.FilePath = applySubstitutePaths(loc.FilePath, rules)
+	for _, prefix := range prefixes {
+		if pi := strings.Index(loc.FilePath, prefix); pi >= 0 {
+			loc.FilePath = loc.FilePath[pi:]
+			break
+		}
+	}
+}
+
+// NormalizePath applies the given substitute-path rules and path prefixes
+// to the cached location's FilePath. Because the location cached by
+// FunctionLocation or ThisCodeLocation is computed once and reused
+// thereafter, call this after changing SubstitutePaths or PathPrefixes
+// configuration if the cached value needs to reflect the new rules.
+func (c *CachedCodeLocation) NormalizePath(rules []SubstituteRule, prefixes []string) {
+	if c.Location != nil {
+		NormalizePath(c.Location, rules, prefixes)
+	}
+}
+
 func removeCodeLevelMetrics(remAttr func(string)) {
 	remAttr(AttributeCodeLineno)
 	remAttr(AttributeCodeNamespace)
@@ -378,12 +912,10 @@ func removeCodeLevelMetrics(remAttr func(string)) {
 	remAttr(AttributeCodeFunction)
 }
 
-//
 // Evaluate a set of TraceOptions, returning a pointer to a new traceOptSet struct
 // initialized from those options. To avoid any unnecessary performance penalties,
 // if we encounter an option that suppresses CLM collection, we stop without evaluating
 // anything further.
-//
 func resolveCLMTraceOptions(options []TraceOption) *traceOptSet {
 	optSet := traceOptSet{}
 	for _, o := range options {
@@ -395,7 +927,30 @@ func resolveCLMTraceOptions(options []TraceOption) *traceOptSet {
 	return &optSet
 }
 
+var clmCacheConfiguredOnce sync.Once
+
+// configureCLMResolverCacheFromRun performs the one-time, lazy default
+// configuration of the process-wide resolver cache from the first
+// appRun's ResolverCache settings. It defers to any configuration already
+// installed via a direct ConfigureCLMResolverCache call, since the cache
+// is process-wide: the first application connected picks the default,
+// but a caller that explicitly configured the cache (as tests, or a
+// process hosting multiple differently-configured applications, should)
+// always wins.
+func configureCLMResolverCacheFromRun(run *appRun) {
+	clmCacheMu.Lock()
+	defer clmCacheMu.Unlock()
+	if clmCacheExplicitlyConfigured {
+		return
+	}
+	clmCache = newCLMResolverCache(run.Config.CodeLevelMetrics.ResolverCache)
+}
+
 func reportCodeLevelMetrics(tOpts traceOptSet, run *appRun, setAttr func(string, string, interface{})) {
+	clmCacheConfiguredOnce.Do(func() {
+		configureCLMResolverCacheFromRun(run)
+	})
+
 	var location CodeLocation
 
 	if tOpts.LocationOverride != nil {
@@ -404,10 +959,6 @@ func reportCodeLevelMetrics(tOpts traceOptSet, run *appRun, setAttr func(string,
 		pcs := make([]uintptr, 10)
 		depth := runtime.Callers(2, pcs)
 		if depth > 0 {
-			frames := runtime.CallersFrames(pcs[:depth])
-			moreToRead := true
-			var frame runtime.Frame
-
 			if tOpts.IgnoredPrefixes == nil {
 				tOpts.IgnoredPrefixes = run.Config.CodeLevelMetrics.IgnoredPrefixes
 				// for backward compatibility, add the singleton IgnoredPrefix if there is one
@@ -419,27 +970,40 @@ func reportCodeLevelMetrics(tOpts traceOptSet, run *appRun, setAttr func(string,
 				}
 			}
 
-			// skip out to first non-agent frame, unless that IS the top-most frame
-			for moreToRead {
-				frame, moreToRead = frames.Next()
-				if func() bool {
-					for _, eachPrefix := range tOpts.IgnoredPrefixes {
-						if strings.HasPrefix(frame.Function, eachPrefix) {
-							return false
-						}
-					}
-					return true
-				}() {
-					break
-				}
+			if tOpts.ApplicationModule == "" {
+				tOpts.ApplicationModule = run.Config.CodeLevelMetrics.ApplicationModule
 			}
 
-			location.FilePath = frame.File
-			location.Function = frame.Function
-			location.LineNo = frame.Line
+			cacheKey := clmCacheKey{
+				kind:  clmCacheKindStackWalk,
+				pc:    pcs[0],
+				extra: hashCLMStackWalkKey(pcs[:depth], tOpts.IgnoredPrefixes, tOpts.ApplicationModule),
+			}
+
+			if cached, ok := currentCLMResolverCache().get(cacheKey); ok {
+				location = cached.location
+			} else {
+				frame := resolveCallingFrame(runtime.CallersFrames(pcs[:depth]), tOpts.IgnoredPrefixes, tOpts.ApplicationModule)
+
+				location.FilePath = frame.File
+				location.Function = frame.Function
+				location.LineNo = frame.Line
+
+				currentCLMResolverCache().put(cacheKey, clmCacheValue{location: location, framePC: frame.PC})
+			}
 		}
 	}
 
+	if tOpts.SubstitutePaths == nil {
+		tOpts.SubstitutePaths = run.Config.CodeLevelMetrics.SubstitutePaths
+	}
+
+	// rewrite the path via any configured substitute-path rules before
+	// trimming prefixes, so the two subsystems compose as expected
+	if tOpts.SubstitutePaths != nil {
+		location.FilePath = applySubstitutePaths(location.FilePath, tOpts.SubstitutePaths)
+	}
+
 	if tOpts.PathPrefixes == nil {
 		tOpts.PathPrefixes = run.Config.CodeLevelMetrics.PathPrefixes
 		// bring in a value still lingering in the deprecated PathPrefix field if the user put one there on their own
@@ -0,0 +1,224 @@
+// Copyright 2022 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package newrelic
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCLMResolverCacheSupportabilityMetrics(t *testing.T) {
+	ConfigureCLMResolverCache(ResolverCacheConfig{})
+	defer ConfigureCLMResolverCache(ResolverCacheConfig{})
+
+	key := clmCacheKey{kind: clmCacheKindFunction, pc: 0x1234}
+
+	// first lookup is a miss
+	if _, ok := currentCLMResolverCache().get(key); ok {
+		t.Fatalf("expected a cache miss for a key that was never populated")
+	}
+	currentCLMResolverCache().put(key, clmCacheValue{location: CodeLocation{Function: "pkg.Fn"}})
+
+	// second lookup is a hit
+	if _, ok := currentCLMResolverCache().get(key); !ok {
+		t.Fatalf("expected a cache hit after populating the key")
+	}
+
+	metrics := CLMResolverCacheSupportabilityMetrics()
+	if metrics[metricNameCLMCacheHit] != 1 {
+		t.Errorf("%s = %d, want 1", metricNameCLMCacheHit, metrics[metricNameCLMCacheHit])
+	}
+	if metrics[metricNameCLMCacheMiss] != 1 {
+		t.Errorf("%s = %d, want 1", metricNameCLMCacheMiss, metrics[metricNameCLMCacheMiss])
+	}
+}
+
+// reportLikeCallers mimics the runtime.Callers(2, pcs) call inside
+// reportCodeLevelMetrics: the returned pcs[0] is the caller of
+// reportLikeCallers, i.e. whatever shared helper invoked it.
+//
+// go:noinline is required on this and sharedAgentHelper below: without
+// it, the compiler collapses these trivial one-line forwarding calls
+// away entirely, which would silently turn every handler into its own
+// distinct immediate caller and defeat the point of this test.
+//
+//go:noinline
+func reportLikeCallers() []uintptr {
+	pcs := make([]uintptr, 10)
+	depth := runtime.Callers(2, pcs)
+	return pcs[:depth]
+}
+
+// sharedAgentHelper stands in for a single shared entrypoint (such as a
+// common segment-starting helper) through which many different user
+// handlers reach CLM reporting. Every call to sharedAgentHelper invokes
+// reportLikeCallers from the exact same source line, so pcs[0] observed
+// by reportLikeCallers is identical no matter who called sharedAgentHelper.
+//
+//go:noinline
+func sharedAgentHelper() []uintptr {
+	return reportLikeCallers()
+}
+
+func handlerOneThroughSharedHelper() []uintptr { return sharedAgentHelper() }
+func handlerTwoThroughSharedHelper() []uintptr { return sharedAgentHelper() }
+
+func TestHashCLMStackWalkKeyDistinguishesCallersOfASharedHelper(t *testing.T) {
+	pcsA := handlerOneThroughSharedHelper()
+	pcsB := handlerTwoThroughSharedHelper()
+
+	if len(pcsA) == 0 || len(pcsB) == 0 {
+		t.Fatal("expected runtime.Callers to capture at least one frame")
+	}
+	if pcsA[0] != pcsB[0] {
+		t.Fatalf("test setup invalid: expected both handlers to share the same immediate-caller pc via sharedAgentHelper, got %v and %v", pcsA[0], pcsB[0])
+	}
+
+	keyA := hashCLMStackWalkKey(pcsA, nil, "")
+	keyB := hashCLMStackWalkKey(pcsB, nil, "")
+	if keyA == keyB {
+		t.Errorf("hashCLMStackWalkKey collided for two distinct handlers that share only their immediate caller; got %v for both", keyA)
+	}
+}
+
+// thisCodeLocationAtOneCallSite calls ThisCodeLocation from a single,
+// fixed call site so repeated invocations share the same caller PC.
+//
+//go:noinline
+func thisCodeLocationAtOneCallSite() *CodeLocation {
+	return ThisCodeLocation()
+}
+
+func TestThisCodeLocationUsesResolverCache(t *testing.T) {
+	ConfigureCLMResolverCache(ResolverCacheConfig{})
+	defer ConfigureCLMResolverCache(ResolverCacheConfig{})
+
+	first := thisCodeLocationAtOneCallSite()
+	if first.Function == "" {
+		t.Fatal("expected ThisCodeLocation to resolve a function name")
+	}
+
+	hits, _ := currentCLMResolverCache().Stats()
+
+	second := thisCodeLocationAtOneCallSite()
+	if second.Function != first.Function || second.LineNo != first.LineNo {
+		t.Errorf("expected repeated calls at the same call site to resolve identically, got %+v and %+v", first, second)
+	}
+
+	newHits, _ := currentCLMResolverCache().Stats()
+	if newHits != hits+1 {
+		t.Errorf("expected the second ThisCodeLocation call to be served from the cache, hits went from %d to %d", hits, newHits)
+	}
+}
+
+func TestIsApplicationModuleFrame(t *testing.T) {
+	const mod = "github.com/acme/svc"
+
+	testCases := []struct {
+		name     string
+		function string
+		mod      string
+		want     bool
+	}{
+		{"root package function", mod + ".Handler", mod, true},
+		{"subpackage function", mod + "/internal/foo.Bar", mod, true},
+		{"sibling module is not a match", "github.com/acme/svc-utils.Helper", mod, false},
+		{"unrelated module", "github.com/other/thing.Handler", mod, false},
+		{"exact module path with no function suffix", mod, mod, true},
+		// auto-generated closure and deferred-callback names are still
+		// prefixed with the enclosing function's fully-qualified name, so
+		// they are attributed to the same package without special-casing.
+		{"closure literal", mod + ".Handler.func1", mod, true},
+		{"deferred callback closure", mod + ".Handler.func2.1", mod, true},
+		{"no module configured", mod + ".Handler", "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isApplicationModuleFrame(tc.function, tc.mod); got != tc.want {
+				t.Errorf("isApplicationModuleFrame(%q, %q) = %v, want %v", tc.function, tc.mod, got, tc.want)
+			}
+		})
+	}
+}
+
+// currentPackagePrefix returns the fully-qualified package path of its
+// caller, derived from a real runtime.Frame rather than hard-coded, so
+// these tests work regardless of the module path this tree is checked
+// out under.
+func currentPackagePrefix() string {
+	pcs := make([]uintptr, 1)
+	runtime.Callers(2, pcs)
+	frame, _ := runtime.CallersFrames(pcs).Next()
+	if idx := strings.LastIndex(frame.Function, "."); idx >= 0 {
+		return frame.Function[:idx]
+	}
+	return frame.Function
+}
+
+// innerFrames captures the real call stack starting at its own caller, for
+// feeding into resolveCallingFrame.
+func innerFrames() *runtime.Frames {
+	pcs := make([]uintptr, 10)
+	depth := runtime.Callers(2, pcs)
+	return runtime.CallersFrames(pcs[:depth])
+}
+
+func TestResolveCallingFrameAppModulePicksApplicationFrame(t *testing.T) {
+	mod := currentPackagePrefix()
+
+	frame := resolveCallingFrame(innerFrames(), nil, mod)
+
+	if !strings.HasPrefix(frame.Function, mod) {
+		t.Fatalf("expected resolved frame to belong to module %q, got %q", mod, frame.Function)
+	}
+	if !strings.Contains(frame.Function, "TestResolveCallingFrameAppModulePicksApplicationFrame") {
+		t.Errorf("expected the innermost application frame (this test) to be chosen, got %q", frame.Function)
+	}
+}
+
+func TestResolveCallingFrameFallsBackToIgnoredPrefixes(t *testing.T) {
+	mod := currentPackagePrefix()
+	const noSuchModule = "no/such/module/in/this/stack"
+
+	// no frame belongs to noSuchModule, so resolution must fall back to
+	// the ignored-prefix walk, skipping frames in our own package and
+	// landing on the (non-ignored) testing package frame above it.
+	frame := resolveCallingFrame(innerFrames(), []string{mod}, noSuchModule)
+
+	if strings.HasPrefix(frame.Function, mod) {
+		t.Errorf("expected fallback to skip frames in the ignored package %q, got %q", mod, frame.Function)
+	}
+}
+
+func TestConfigureCLMResolverCacheWinsOverAutomaticConfiguration(t *testing.T) {
+	defer func() {
+		clmCacheMu.Lock()
+		clmCacheExplicitlyConfigured = false
+		clmCacheMu.Unlock()
+		ConfigureCLMResolverCache(ResolverCacheConfig{})
+	}()
+
+	ConfigureCLMResolverCache(ResolverCacheConfig{Disabled: true})
+
+	clmCacheMu.RLock()
+	explicit := clmCacheExplicitlyConfigured
+	clmCacheMu.RUnlock()
+	if !explicit {
+		t.Fatal("expected ConfigureCLMResolverCache to mark the cache as explicitly configured")
+	}
+
+	// configureCLMResolverCacheFromRun is only ever invoked lazily, via
+	// reportCodeLevelMetrics's sync.Once, from the first appRun it
+	// observes; it must not clobber a configuration set explicitly,
+	// regardless of call order. Passing nil is safe here because an
+	// explicitly configured cache makes the function return before it
+	// would dereference run.
+	configureCLMResolverCacheFromRun(nil)
+
+	if !currentCLMResolverCache().disabled {
+		t.Error("expected the explicitly configured (disabled) cache to survive a later automatic configuration attempt")
+	}
+}